@@ -0,0 +1,40 @@
+package pkg
+
+import (
+	bolt "github.com/boltdb/bolt"
+	"golang.org/x/xerrors"
+)
+
+//stateBucket holds the generic key/value pairs used by StateStore.Save/Load,
+//keeping the per-consumer buckets (users, access, ...) untouched.
+var stateBucket = []byte("state")
+
+//Save writes an arbitrary key/value pair, satisfying the generic half of
+//StateStore for consumers that don't need a dedicated bucket.
+func (db *AgentDB) Save(key string, data []byte) error {
+	return db.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return xerrors.Errorf("failed to create state bucket: %w", err)
+		}
+		return bucket.Put([]byte(key), data)
+	})
+}
+
+//Load reads an arbitrary key/value pair written by Save.
+func (db *AgentDB) Load(key string) ([]byte, error) {
+	var data []byte
+	err := db.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateBucket)
+		if bucket == nil {
+			return xerrors.Errorf("state bucket does not exist: %w", ErrKeyNotFound)
+		}
+		value := bucket.Get([]byte(key))
+		if value == nil {
+			return xerrors.Errorf("key %q not found: %w", key, ErrKeyNotFound)
+		}
+		data = append(data, value...)
+		return nil
+	})
+	return data, err
+}
@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+//statAttrEntry reads the current mode/uid/gid of a path via lstat, plus its
+//extended attributes so changes made by the __vfs_setxattr kprobe are
+//actually baselined. Unlike NewKey, which uses stat, lstat does not follow
+//a final symlink.
+func statAttrEntry(path string) (AttrEntry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return AttrEntry{}, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return AttrEntry{}, xerrors.Errorf("could not read stat_t for %q", path)
+	}
+	xattrs, err := listXattrs(path)
+	if err != nil {
+		return AttrEntry{}, err
+	}
+	return AttrEntry{Mode: uint32(stat.Mode), UID: stat.Uid, GID: stat.Gid, Xattrs: xattrs}, nil
+}
+
+//listXattrs reads every extended attribute name/value pair set on path via
+//listxattr(2)/getxattr(2). A filesystem with no xattr support is treated the
+//same as a path with none set, rather than as an error.
+func listXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("failed to list xattrs for %q: %w", path, err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	n, err := syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to list xattrs for %q: %w", path, err)
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range splitXattrNames(buf[:n]) {
+		valueSize, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to size xattr %q for %q: %w", name, path, err)
+		}
+		value := make([]byte, valueSize)
+		if valueSize > 0 {
+			if _, err := syscall.Getxattr(path, name, value); err != nil {
+				return nil, xerrors.Errorf("failed to read xattr %q for %q: %w", name, path, err)
+			}
+		}
+		xattrs[name] = string(value)
+	}
+	return xattrs, nil
+}
+
+//splitXattrNames splits the NUL-separated attribute name list returned by
+//listxattr(2) into individual names.
+func splitXattrNames(buf []byte) []string {
+	var names []string
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names
+}
+
+//AttrEntry captures the permission/ownership/xattr state of a single watched path.
+type AttrEntry struct {
+	Mode   uint32            `json:"mode"`
+	UID    uint32            `json:"uid"`
+	GID    uint32            `json:"gid"`
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+}
+
+//equal compares two entries field by field, since Xattrs (a map) makes
+//AttrEntry non-comparable with ==.
+func (a AttrEntry) equal(other AttrEntry) bool {
+	if a.Mode != other.Mode || a.UID != other.UID || a.GID != other.GID {
+		return false
+	}
+	if len(a.Xattrs) != len(other.Xattrs) {
+		return false
+	}
+	for name, value := range a.Xattrs {
+		if other.Xattrs[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+//Attrs is the baseline of watched paths and their permission/ownership state,
+//populated by the chmod_common/chown_common/__vfs_setxattr kprobes.
+type Attrs map[string]AttrEntry
+
+//IsEmpty reports whether the baseline has no entries.
+func (a Attrs) IsEmpty() bool { return len(a) == 0 }
+
+//attrDiff returns the entries added and removed between two Attrs baselines,
+//mirroring userDiff/accessDiff.
+func attrDiff(current, next Attrs) (add, del Attrs) {
+	add, del = Attrs{}, Attrs{}
+	for path, entry := range next {
+		if old, ok := current[path]; !ok || !old.equal(entry) {
+			add[path] = entry
+		}
+	}
+	for path, entry := range current {
+		if _, ok := next[path]; !ok {
+			del[path] = entry
+		}
+	}
+	return add, del
+}
+
+//AttrListener watches a set of files for permission/ownership/xattr changes
+//and parses their current state, the same role UsersListener/AccessListener
+//play for their respective consumers.
+type AttrListener struct {
+	Includes []string
+	zerolog.Logger
+}
+
+//parse builds the current Attrs baseline for every included path.
+func (al *AttrListener) parse() (Attrs, error) {
+	attrs := make(Attrs, len(al.Includes))
+	for _, path := range al.Includes {
+		entry, err := statAttrEntry(path)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to stat attrs for %q: %w", path, err)
+		}
+		attrs[path] = entry
+	}
+	return attrs, nil
+}
+
+//Register returns the list of files this listener watches.
+func (al *AttrListener) Register() []string {
+	return al.Includes
+}
+
+//LogAttrs adapts Attrs to zerolog's Object() logging.
+type LogAttrs Attrs
+
+//MarshalZerologObject implements zerolog.LogObjectMarshaler.
+func (a LogAttrs) MarshalZerologObject(e *zerolog.Event) {
+	for path, entry := range a {
+		e.Uint32(path+".mode", entry.Mode).
+			Uint32(path+".uid", entry.UID).
+			Uint32(path+".gid", entry.GID)
+	}
+}
+
+func encodeAttrs(attrs Attrs) ([]byte, error) {
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to encode attrs baseline: %w", err)
+	}
+	return data, nil
+}
+
+func decodeAttrs(data []byte) (Attrs, error) {
+	var attrs Attrs
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return nil, xerrors.Errorf("failed to decode attrs baseline: %w", err)
+	}
+	return attrs, nil
+}
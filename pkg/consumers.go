@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"errors"
 	"os"
 	"sync"
 	"time"
@@ -8,18 +9,25 @@ import (
 	"github.com/rs/zerolog"
 )
 
+const (
+	stageParse = "parse"
+	stageSave  = "save"
+)
+
 type (
 	//State describes the interface for maintaining state of instances for a consumer
 	State interface {
 		Changed() bool
 		Created() bool
-		Notify(string)
+		//Notify reports a change; containerID is empty when the triggering
+		//event wasn't resolved to a container (e.g. baseInit).
+		Notify(cmd, containerID string)
 		Teardown() error
 	}
 	//ParserLoader describes the interface for maintaining the data in a consumer
 	ParserLoader interface {
-		Load(db *AgentDB) error
-		Save(db *AgentDB) error
+		Load(store StateStore) error
+		Save(store StateStore) error
 		Parse() (State, error)
 		Register() []string
 	}
@@ -28,15 +36,71 @@ type (
 
 	//BaseConsumer is a struct that contains the base objects needed to make a consumer
 	BaseConsumer struct {
-		*AgentDB
+		StateStore
 		ParserLoader
 		sync.RWMutex
+		//Metrics is optional; when set, Consume reports parse/save latency to it.
+		Metrics *Metrics
+		//Name identifies this consumer in NotifySink events, e.g. "users" or "access".
+		Name string
+		//Errors receives NotifySink overflow/send failures, typically FIM.Errors.
+		Errors chan error
+		//RemoteStore is optional; when set, Init reconciles the local baseline
+		//against it before parsing, so a fleet of agents can share a baseline.
+		RemoteStore StateStore
+		sinks       []*bufferedSink
 	}
 )
 
+func (bc *BaseConsumer) observeLatency(stage string, start time.Time) {
+	if bc.Metrics == nil || bc.Metrics.Prometheus == nil {
+		return
+	}
+	bc.Metrics.Prometheus.ObserveConsumeLatency(stage, time.Since(start).Seconds())
+}
+
+//AddSink registers a NotifySink to receive this consumer's Notify events, in
+//addition to the default zerolog warn stream. Each sink gets its own bounded
+//queue so a slow remote sink can't block another sink or the consumer itself.
+func (bc *BaseConsumer) AddSink(sink NotifySink) {
+	bc.sinks = append(bc.sinks, newBufferedSink(sink, bc.Errors))
+}
+
+//notifySinks fans a Notify event out to every registered NotifySink.
+func (bc *BaseConsumer) notifySinks(process, containerID, message string) {
+	if len(bc.sinks) == 0 {
+		return
+	}
+	event := NotifyEvent{
+		Consumer:    bc.Name,
+		Process:     process,
+		ContainerID: containerID,
+		Message:     message,
+		Timestamp:   time.Now(),
+	}
+	for _, sink := range bc.sinks {
+		_ = sink.Send(event)
+	}
+}
+
 //Init function for populating a base consumer
 func (bc *BaseConsumer) Init() error {
-	if err := bc.Load(bc.AgentDB); err != nil {
+	//Sync only knows how to reconcile the users+access baselines it was
+	//written for, so it's only invoked for the consumers that own those
+	//baselines. A RemoteStore on an AttrState consumer (or any future
+	//ParserLoader Sync hasn't been taught about) would otherwise diff/adopt
+	//the wrong keys and never touch the baseline it actually owns.
+	switch bc.ParserLoader.(type) {
+	case *UsersState, *AccessState:
+		if bc.RemoteStore != nil {
+			if err := Sync(bc.StateStore, bc.RemoteStore); err != nil && err != ErrReload {
+				return err
+			} else if err == ErrReload {
+				return ErrReload
+			}
+		}
+	}
+	if err := bc.ParserLoader.Load(bc.StateStore); err != nil {
 		return err
 	}
 	state, err := bc.Parse()
@@ -44,9 +108,10 @@ func (bc *BaseConsumer) Init() error {
 		return err
 	}
 	if !state.Created() && state.Changed() {
-		state.Notify("baseInit")
+		state.Notify("baseInit", "")
+		bc.notifySinks("baseInit", "", "state changed during initialization")
 	}
-	if err := bc.Save(bc.AgentDB); err != nil {
+	if err := bc.ParserLoader.Save(bc.StateStore); err != nil {
 		return err
 	}
 	if err := state.Teardown(); err == nil || err == ErrReload {
@@ -59,15 +124,24 @@ func (bc *BaseConsumer) Init() error {
 func (bc *BaseConsumer) Consume(e Event) error {
 	bc.Lock()
 	defer bc.Unlock()
+	parseStart := time.Now()
 	state, err := bc.Parse()
+	bc.observeLatency(stageParse, parseStart)
 	if err != nil {
 		return err
 	}
 	if !state.Changed() {
 		return state.Teardown()
 	}
-	state.Notify(e.Com)
-	if err := bc.Save(bc.AgentDB); err != nil {
+	state.Notify(e.Com, e.ContainerID)
+	bc.notifySinks(e.Com, e.ContainerID, "state changed")
+	if bc.Metrics != nil {
+		bc.Metrics.RecordConsumerEvent(bc.Name)
+	}
+	saveStart := time.Now()
+	err = bc.ParserLoader.Save(bc.StateStore)
+	bc.observeLatency(stageSave, saveStart)
+	if err != nil {
 		return err
 	}
 	return state.Teardown()
@@ -124,13 +198,14 @@ func (us *UsersState) Changed() bool {
 func (us *UsersState) Created() bool { return len(us.current.users) == 0 }
 
 //Notify is the method to notify of a change in state
-func (us *UsersState) Notify(cmd string) {
+func (us *UsersState) Notify(cmd, containerID string) {
 	add, del := userDiff(us.current.users, us.next.users)
 	us.Warn().
 		Array("users", LogUsers(us.next.users)).
 		Array("add", LogUsers(add)).
 		Array("del", LogUsers(del)).
 		Str("processName", cmd).
+		Str("containerID", containerID).
 		Msg("Users Modified")
 }
 
@@ -156,15 +231,15 @@ func (us *UsersState) Register() []string {
 	return us.UsersListener.Register(us.current.includes)
 }
 
-//Save commits a state to the local DB instance.
-func (us *UsersState) Save(db *AgentDB) error {
+//Save commits a state to the configured StateStore.
+func (us *UsersState) Save(store StateStore) error {
 	us.Debug().Array("users", LogUsers(us.next.users)).Msg("save users")
-	return db.SaveUsers(us.next.users)
+	return store.SaveUsers(us.next.users)
 }
 
-//Load reads in current state from local db instance
-func (us *UsersState) Load(db *AgentDB) error {
-	users, err := db.LoadUsers()
+//Load reads in current state from the configured StateStore.
+func (us *UsersState) Load(store StateStore) error {
+	users, err := store.LoadUsers()
 	if err != nil {
 		return err
 	}
@@ -202,13 +277,14 @@ func (as *AccessState) Changed() bool {
 func (as *AccessState) Created() bool { return as.current.IsEmpty() }
 
 //Notify is the method to notify of a change in state
-func (as *AccessState) Notify(cmd string) {
+func (as *AccessState) Notify(cmd, containerID string) {
 	add, del := accessDiff(as.current, as.next)
 	as.Warn().
 		Object("access", LogAccess(as.next)).
 		Object("add", LogAccess(add)).
 		Object("del", LogAccess(del)).
 		Str("processName", cmd).
+		Str("containerID", containerID).
 		Msg("access entries")
 }
 
@@ -218,18 +294,97 @@ func (as *AccessState) Teardown() error {
 	return nil
 }
 
-//Save commits a state to the local DB instance.
-func (as *AccessState) Save(db *AgentDB) error {
+//Save commits a state to the configured StateStore.
+func (as *AccessState) Save(store StateStore) error {
 	as.Debug().Object("access", LogAccess(as.next)).Msg("save access")
-	return db.SaveAccess(as.next)
+	return store.SaveAccess(as.next)
 }
 
-//Load reads in current state from local db instance
-func (as *AccessState) Load(db *AgentDB) (err error) {
-	as.current, err = db.LoadAccess()
+//Load reads in current state from the configured StateStore.
+func (as *AccessState) Load(store StateStore) (err error) {
+	as.current, err = store.LoadAccess()
 	return
 }
 
+/* ---------------------------------- ATTR ---------------------------------- */
+
+type (
+	//AttrState struct keeps track of state changes based on AttrListener struct
+	//and methods. It reacts to the chmod/chown/setxattr kprobes the same way
+	//AccessState reacts to writes on the access-control files it watches.
+	AttrState struct {
+		*AttrListener
+		current, next Attrs
+	}
+)
+
+//Parse calls parse(), and update new AttrState
+func (as *AttrState) Parse() (State, error) {
+	attrs, err := as.parse()
+	if err != nil {
+		return nil, err
+	}
+	as.next = attrs
+	return as, nil
+}
+
+//Changed checks if the new AttrState instance is different from old AttrState instance
+func (as *AttrState) Changed() bool {
+	add, del := attrDiff(as.current, as.next)
+	return !add.IsEmpty() || !del.IsEmpty()
+}
+
+//Created checks if the current AttrState has been created
+func (as *AttrState) Created() bool { return as.current.IsEmpty() }
+
+//Notify is the method to notify of a change in state
+func (as *AttrState) Notify(cmd, containerID string) {
+	add, del := attrDiff(as.current, as.next)
+	as.Warn().
+		Object("attrs", LogAttrs(as.next)).
+		Object("add", LogAttrs(add)).
+		Object("del", LogAttrs(del)).
+		Str("processName", cmd).
+		Str("containerID", containerID).
+		Msg("permission/ownership entries")
+}
+
+//Teardown is the reset method when a change has been detected. Set new state to old state, and reload.
+func (as *AttrState) Teardown() error {
+	as.current = as.next
+	return nil
+}
+
+//Save commits a state to the configured StateStore.
+func (as *AttrState) Save(store StateStore) error {
+	as.Debug().Object("attrs", LogAttrs(as.next)).Msg("save attrs")
+	data, err := encodeAttrs(as.next)
+	if err != nil {
+		return err
+	}
+	return store.Save("attrs", data)
+}
+
+//Load reads in current state from the configured StateStore. A fresh agent
+//has no "attrs" key yet, so a not-found error is treated as an empty
+//baseline rather than a startup failure. UsersState.Load and AccessState.Load
+//return a not-found error from LoadUsers/LoadAccess unchanged.
+func (as *AttrState) Load(store StateStore) error {
+	data, err := store.Load("attrs")
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	attrs, err := decodeAttrs(data)
+	if err != nil {
+		return err
+	}
+	as.current = attrs
+	return nil
+}
+
 /* ------------------------------ NOP CONSUMER ------------------------------ */
 type nopConsumer struct{}
 
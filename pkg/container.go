@@ -0,0 +1,210 @@
+package pkg
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//processEnrichment is the container/namespace/effective-credential metadata
+//resolved from /proc for a single process.
+type processEnrichment struct {
+	ContainerID    string
+	PIDNamespace   uint64
+	MountNamespace uint64
+	UserNamespace  uint64
+	EffectiveUID   uint32
+	EffectiveGID   uint32
+}
+
+const processCacheSize = 4096
+
+//cgroupContainerRE matches the container ID out of a cgroup path for
+//docker, containerd, and cri-o, e.g. .../docker/<id>, .../cri-containerd-<id>.scope.
+var cgroupContainerRE = regexp.MustCompile(`(?:docker[-/]|cri-containerd[-:]|crio[-:])([0-9a-f]{12,64})`)
+
+//nsInodeRE extracts the inode number out of a /proc/<pid>/ns/<ns> symlink
+//target, e.g. "pid:[4026531836]".
+var nsInodeRE = regexp.MustCompile(`:\[(\d+)\]`)
+
+type processCacheKey struct {
+	pid       uint32
+	startTime uint64
+}
+
+//processCache is a small LRU keyed by (pid, starttime) so repeated events
+//from the same process don't re-read /proc on every event.
+type processCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[processCacheKey]*list.Element
+	order    *list.List
+}
+
+type processCacheEntry struct {
+	key   processCacheKey
+	value processEnrichment
+}
+
+func newProcessCache(capacity int) *processCache {
+	return &processCache{
+		capacity: capacity,
+		entries:  make(map[processCacheKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+//resolve returns the cached enrichment for pid if its /proc/<pid>/stat
+//starttime still matches, otherwise it re-reads /proc and refreshes the cache.
+func (c *processCache) resolve(pid uint32) (processEnrichment, error) {
+	startTime, err := processStartTime(pid)
+	if err != nil {
+		return processEnrichment{}, err
+	}
+	key := processCacheKey{pid: pid, startTime: startTime}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		value := elem.Value.(*processCacheEntry).value
+		c.mu.Unlock()
+		return value, nil
+	}
+	c.mu.Unlock()
+
+	enrichment, err := enrichProcess(pid)
+	if err != nil {
+		return processEnrichment{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem := c.order.PushFront(&processCacheEntry{key: key, value: enrichment})
+	c.entries[key] = elem
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*processCacheEntry).key)
+		}
+	}
+	return enrichment, nil
+}
+
+//processStartTime reads the process start time (field 22) from
+///proc/<pid>/stat, used to detect pid reuse in the cache key.
+func processStartTime(pid uint32) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// Fields after the (possibly space-containing) comm field are safe to
+	// split on whitespace; comm is delimited by the last ')'.
+	fields := strings.Fields(string(data[strings.LastIndex(string(data), ")")+1:]))
+	const startTimeField = 19 // index into fields, 0-based; fields[0] is state (field 3)
+	if len(fields) <= startTimeField {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	return strconv.ParseUint(fields[startTimeField], 10, 64)
+}
+
+//enrichProcess reads /proc/<pid>/cgroup, /proc/<pid>/ns/*, and
+///proc/<pid>/status to resolve container ID, namespace inodes, and
+//effective uid/gid for pid.
+func enrichProcess(pid uint32) (processEnrichment, error) {
+	var enrichment processEnrichment
+
+	if containerID, err := containerIDFromCgroup(pid); err == nil {
+		enrichment.ContainerID = containerID
+	}
+
+	if inode, err := namespaceInode(pid, "pid"); err == nil {
+		enrichment.PIDNamespace = inode
+	}
+	if inode, err := namespaceInode(pid, "mnt"); err == nil {
+		enrichment.MountNamespace = inode
+	}
+	if inode, err := namespaceInode(pid, "user"); err == nil {
+		enrichment.UserNamespace = inode
+	}
+
+	euid, egid, err := effectiveCredentials(pid)
+	if err != nil {
+		return enrichment, err
+	}
+	enrichment.EffectiveUID = euid
+	enrichment.EffectiveGID = egid
+
+	return enrichment, nil
+}
+
+func containerIDFromCgroup(pid uint32) (string, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if match := cgroupContainerRE.FindStringSubmatch(scanner.Text()); match != nil {
+			return match[1], nil
+		}
+	}
+	return "", fmt.Errorf("no container cgroup found for pid %d", pid)
+}
+
+func namespaceInode(pid uint32, ns string) (uint64, error) {
+	target, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, ns))
+	if err != nil {
+		return 0, err
+	}
+	match := nsInodeRE.FindStringSubmatch(target)
+	if match == nil {
+		return 0, fmt.Errorf("unexpected ns link format %q", target)
+	}
+	return strconv.ParseUint(match[1], 10, 64)
+}
+
+func effectiveCredentials(pid uint32) (uid, gid uint32, err error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "Uid:"):
+			if uid, err = parseEffectiveField(line); err != nil {
+				return 0, 0, err
+			}
+		case strings.HasPrefix(line, "Gid:"):
+			if gid, err = parseEffectiveField(line); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+//parseEffectiveField parses the effective (second) column of a
+//"Uid:"/"Gid:" line in /proc/<pid>/status, e.g. "Uid:\t1000\t1000\t1000\t1000".
+func parseEffectiveField(line string) (uint32, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return 0, fmt.Errorf("unexpected status line %q", line)
+	}
+	value, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(value), nil
+}
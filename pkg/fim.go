@@ -10,6 +10,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/iovisor/gobpf/elf"
@@ -21,30 +22,117 @@ const (
 	resultTableName = "events"
 	rulesTableName  = "rules"
 	taskComLen      = 16
+	xattrNameLen    = 64
 	chanSize        = 10 // totally arbitrary for now
 	bpfAny          = 0  // flag for map updates.
+
+	//defaultPerfPageCount is the number of per-CPU pages backing the perf
+	//buffer when the caller doesn't override it with WithPerfPageCount.
+	defaultPerfPageCount = 64
+	//backpressureThreshold is the fraction of f.Events' capacity at which the
+	//ingest loop starts coalescing duplicate events instead of enqueuing each one.
+	backpressureThreshold = 0.8
+	//coalesceWindowMin/Max bound the self-tuning coalesce window: it grows
+	//towards Max under sustained high event rates and decays back to Min
+	//once the rate settles.
+	coalesceWindowMin = 50 * time.Millisecond
+	coalesceWindowMax = 2 * time.Second
+	//queueDepthSampleInterval is how often f.Events' current length is
+	//reported to Prometheus, when configured.
+	queueDepthSampleInterval = 5 * time.Second
+)
+
+//probeNames lists the kprobes attached by bpf/fim.c, keyed by the function
+//name as it appears in /sys/kernel/debug/tracing/kprobe_profile. Used to
+//filter that file down to bpfink's own probes - it's a system-wide file
+//shared with every other kprobe on the host.
+var probeNames = map[string]bool{
+	"pvfs_write":    true,
+	"pvfs_rename":   true,
+	"pvfs_unlink":   true,
+	"pchmod_common": true,
+	"pchown_common": true,
+	"psetxattr":     true,
+}
+
+//Operation identifies which kprobe produced an Event.
+type Operation uint8
+
+//Operation values mirror the kprobes attached by the eBPF program: writes
+//and renames were the original two probes; unlink/chmod/chown/setxattr were
+//added to cover deletion, permission, ownership, and extended-attribute
+//changes.
+const (
+	OpWrite Operation = iota
+	OpRename
+	OpUnlink
+	OpChmod
+	OpChown
+	OpSetxattr
 )
 
+//String returns the human-readable name of the operation, used in logs.
+func (o Operation) String() string {
+	switch o {
+	case OpWrite:
+		return "write"
+	case OpRename:
+		return "rename"
+	case OpUnlink:
+		return "unlink"
+	case OpChmod:
+		return "chmod"
+	case OpChown:
+		return "chown"
+	case OpSetxattr:
+		return "setxattr"
+	default:
+		return "unknown"
+	}
+}
+
 type (
 	//Event struct the represents event that is sent to user space from BPF
 	Event struct {
-		Mode   int32
-		PID    uint32
-		UID    uint32
-		Size   uint32
-		Inode  uint64
-		Device uint64
-		Com    string
-		Path   string
+		Op        Operation
+		Mode      int32
+		PID       uint32
+		UID       uint32
+		GID       uint32
+		Size      uint32
+		Inode     uint64
+		Device    uint64
+		Com       string
+		Path      string
+		XattrName string
+		//ContainerID, namespace inodes, and effective uid/gid are resolved from
+		///proc by enrichProcess; they're zero-value when resolution fails (e.g.
+		//the process has already exited).
+		ContainerID    string
+		PIDNamespace   uint64
+		MountNamespace uint64
+		UserNamespace  uint64
+		EffectiveUID   uint32
+		EffectiveGID   uint32
+		//HitCount is 1 for a normal event, or the number of coalesced
+		//duplicate events (same inode, same op) folded into one summary event
+		//emitted under backpressure. See (*FIM).start.
+		HitCount uint32
 	}
+	//rawEvent must stay byte-for-byte compatible with struct event in
+	//bpf/fim.c - same field order, same widths, same padding.
 	rawEvent struct {
+		Op     uint8
+		_      [3]byte // padding to match the eBPF program's struct alignment
 		Mode   int32
 		PID    uint32
 		UID    uint32
+		GID    uint32
 		Size   uint32
 		Inode  uint64
 		Device uint64
 		Com    [taskComLen]byte
+		Xattr  [xattrNameLen]byte
 	}
 	//FIM struct that represents BPF event system
 	FIM struct {
@@ -57,9 +145,43 @@ type (
 		Errors     chan error
 		zerolog.Logger
 		closeChannelLoops chan struct{}
+		//procCache caches container/namespace/euid/egid resolution keyed by
+		//(pid, starttime) so repeated events from the same process don't
+		//re-read /proc.
+		procCache *processCache
+		//Metrics is optional; when set, missed perf/ringbuf events are
+		//reported through it instead of only through Errors.
+		Metrics *Metrics
+		//channelSize and perfPageCount configure the ingest path; both fall
+		//back to sane defaults when left zero. See WithChannelSize/WithPerfPageCount.
+		channelSize   int
+		perfPageCount int
+		coalesce      *coalescer
 	}
+
+	//FIMOption configures a FIM at construction time, following the same
+	//functional-option pattern as NewFileMissing's options.
+	FIMOption func(*FIM)
 )
 
+//WithChannelSize overrides the buffered size of the Events/Errors/perf
+//channels, replacing the fixed chanSize default.
+func WithChannelSize(size int) FIMOption {
+	return func(f *FIM) { f.channelSize = size }
+}
+
+//WithPerfPageCount overrides the number of per-CPU pages backing the perf
+//buffer, replacing defaultPerfPageCount.
+func WithPerfPageCount(pages int) FIMOption {
+	return func(f *FIM) { f.perfPageCount = pages }
+}
+
+//WithFIMMetrics wires a Metrics instance so missed events are reported as a
+//proper metric in addition to the Errors channel.
+func WithFIMMetrics(m *Metrics) FIMOption {
+	return func(f *FIM) { f.Metrics = m }
+}
+
 //NewKey takes a path to file and generates a bpf map key
 func NewKey(name string) (uint64, error) {
 	fstat := &syscall.Stat_t{}
@@ -77,7 +199,7 @@ func Encode(i interface{}) ([]byte, error) {
 }
 
 //InitFIM function to initialize and start BPF
-func InitFIM(bccFile string, logger zerolog.Logger) (*FIM, error) {
+func InitFIM(bccFile string, logger zerolog.Logger, options ...FIMOption) (*FIM, error) {
 	mod := elf.NewModule(bccFile)
 
 	err := mod.Load(nil)
@@ -119,11 +241,18 @@ func InitFIM(bccFile string, logger zerolog.Logger) (*FIM, error) {
 		reverse:           &sync.Map{},
 		Module:            mod,
 		RulesTable:        rulesTable,
-		Events:            make(chan Event, chanSize),
-		Errors:            make(chan error, chanSize),
 		Logger:            logger,
 		closeChannelLoops: make(chan struct{}, 1),
+		procCache:         newProcessCache(processCacheSize),
+		channelSize:       chanSize,
+		perfPageCount:     defaultPerfPageCount,
+	}
+	for _, option := range options {
+		option(fim)
 	}
+	fim.Events = make(chan Event, fim.channelSize)
+	fim.Errors = make(chan error, fim.channelSize)
+	fim.coalesce = newCoalescer(fim.Events)
 
 	return fim, fim.start()
 }
@@ -135,19 +264,26 @@ func (f *FIM) Status() bool {
 
 //Stats method to print status of code
 func (f *FIM) Stats() string {
+	return fmt.Sprintf("Currently watching %d files", f.watchedFileCount())
+}
+
+//watchedFileCount returns the number of files currently registered with BPF.
+func (f *FIM) watchedFileCount() int {
 	count := 0
 	f.mapping.Range(func(key, value interface{}) bool {
 		count++
 		return true
 	})
-
-	return fmt.Sprintf("Currently watching %d files", count)
+	return count
 }
 
 //StopBPF method to clean up bpf after running
 func (f *FIM) StopBPF() error {
 	f.resultsMap.PollStop()
 	close(f.closeChannelLoops)
+	if f.coalesce != nil {
+		f.coalesce.Stop()
+	}
 	f.Debug().Msg("polling stopped")
 	f.mapping.Range(func(key, value interface{}) bool {
 		ukey, ok := key.(uint64)
@@ -181,10 +317,18 @@ func (f *FIM) error(err error) {
 }
 
 func (f *FIM) start() error {
-	eventChannel := make(chan []byte, chanSize)
-	missedChannel := make(chan uint64, chanSize)
+	if ringbufSupported() {
+		f.Debug().Msg("kernel supports BPF_MAP_TYPE_RINGBUF, but gobpf/elf has no ring buffer " +
+			"support yet - falling back to the perf buffer")
+	} else {
+		f.Debug().Msg("kernel lacks BPF_MAP_TYPE_RINGBUF support, using the perf buffer")
+	}
 
-	perfMap, err := elf.InitPerfMap(f.Module, resultTableName, eventChannel, missedChannel)
+	f.Debug().Msgf("perf buffer configured with %d pages per CPU", f.perfPageCount)
+	eventChannel := make(chan []byte, f.channelSize)
+	missedChannel := make(chan uint64, f.channelSize)
+
+	perfMap, err := elf.InitPerfMapWithPageCnt(f.Module, resultTableName, eventChannel, missedChannel, f.perfPageCount)
 	if err != nil {
 		return xerrors.Errorf("unable to init perf map: %w", err)
 	}
@@ -192,6 +336,20 @@ func (f *FIM) start() error {
 	f.resultsMap = perfMap
 
 	perfMap.PollStart()
+	if f.Metrics != nil && f.Metrics.Prometheus != nil {
+		go func() {
+			ticker := time.NewTicker(queueDepthSampleInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					f.Metrics.Prometheus.SetQueueDepth(len(f.Events))
+				case <-f.closeChannelLoops:
+					return
+				}
+			}
+		}()
+	}
 	go func() {
 		for {
 			select {
@@ -200,6 +358,9 @@ func (f *FIM) start() error {
 					return
 				}
 				f.Debug().Msg("missed")
+				if f.Metrics != nil {
+					f.Metrics.RecordMissedEvents(missedCount)
+				}
 				f.error(xerrors.Errorf("log message count: %v", missedCount))
 			case <-f.closeChannelLoops:
 				f.Debug().Msg("chan Closed")
@@ -231,6 +392,13 @@ func (f *FIM) start() error {
 					}
 					cmdline = string(e.Com[:comLen])
 				}
+				xattrLen := 0
+				for index, bit := range e.Xattr {
+					if bit == 0 {
+						xattrLen = index
+						break
+					}
+				}
 				path, ok := f.mapping.Load(e.Inode)
 				if !ok {
 					f.Error().Msgf("could not find key: %v in map", e.Inode)
@@ -247,11 +415,29 @@ func (f *FIM) start() error {
 				if !ok {
 					f.Error().Msgf("could not assert path into string key: %v in map", e.Inode)
 				}
-				f.Events <- Event{
-					e.Mode, e.PID, e.UID, e.Size, e.Inode, e.Device,
-					cmdline,
-					spath,
+				enrichment, err := f.procCache.resolve(e.PID)
+				if err != nil {
+					f.Debug().Err(err).Msgf("could not enrich pid %v from /proc", e.PID)
 				}
+				f.coalesce.Submit(Event{
+					Op:             Operation(e.Op),
+					Mode:           e.Mode,
+					PID:            e.PID,
+					UID:            e.UID,
+					GID:            e.GID,
+					Size:           e.Size,
+					Inode:          e.Inode,
+					Device:         e.Device,
+					Com:            cmdline,
+					Path:           spath,
+					XattrName:      string(e.Xattr[:xattrLen]),
+					ContainerID:    enrichment.ContainerID,
+					PIDNamespace:   enrichment.PIDNamespace,
+					MountNamespace: enrichment.MountNamespace,
+					UserNamespace:  enrichment.UserNamespace,
+					EffectiveUID:   enrichment.EffectiveUID,
+					EffectiveGID:   enrichment.EffectiveGID,
+				})
 			case <-f.closeChannelLoops:
 				f.Debug().Msg("chan Closed")
 				return
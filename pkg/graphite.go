@@ -8,6 +8,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -29,6 +30,15 @@ type Metrics struct {
 	Logger              zerolog.Logger
 	missedCount         map[string]int64
 	hitCount            map[string]int64
+	//Prometheus holds the configuration for the optional Prometheus exporter.
+	//It runs alongside Graphite, rather than replacing it, when both are configured.
+	Prometheus *PrometheusMetrics
+	//Realtime holds the configuration for the optional streaming metrics endpoint.
+	Realtime *RealtimeMetrics
+	//FIM is used by the realtime subsystem to report the watched-file count.
+	FIM            *FIM
+	eventCounts    map[string]uint64
+	eventCountsMux sync.Mutex
 }
 
 type bpfMetrics struct {
@@ -40,8 +50,6 @@ const (
 	graphiteOff = iota + 1
 	graphiteStdout
 	graphiteRemote
-	provbeVfsWrite  = "pvfs_write"
-	provbeVfsRename = "pvfs_rename"
 )
 
 //Init method to start up graphite metrics
@@ -65,6 +73,21 @@ func (m *Metrics) Init() error {
 		go graphite.Graphite(m.EveryMinuteRegister, time.Second*30, "", addr)
 	}
 
+	if m.Prometheus != nil {
+		if err := m.Prometheus.Init(m.Logger); err != nil {
+			return err
+		}
+	}
+
+	if m.Realtime != nil {
+		if m.Realtime.FetchSample == nil {
+			m.Realtime.FetchSample = m.fetchRealtimeSample
+		}
+		if err := m.Realtime.Init(m.Logger); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -76,6 +99,9 @@ func (m *Metrics) RecordByInstalledHost() {
 		metricNameByRole := fmt.Sprintf("installed.by_role.%s.count.hourly", quote(m.RoleName))
 		goMetrics.GetOrRegisterGauge(metricNameByRole, m.EveryHourRegister).Update(int64(1))
 	}
+	if m.Prometheus != nil {
+		m.Prometheus.RecordInstalledHost(m.Hostname, m.RoleName)
+	}
 }
 
 //RecordBPFMetrics send metrics for BPF hits and misses per probe
@@ -92,12 +118,71 @@ func (m *Metrics) RecordBPFMetrics() error {
 				vfsMiss := fmt.Sprintf("bpf.by_host.%s.%s.kprobe.miss_rate.minutely", quote(m.Hostname), key)
 				goMetrics.GetOrRegisterGauge(vfsHit, m.EveryMinuteRegister).Update(BPFMetrics[key].hitRate)
 				goMetrics.GetOrRegisterGauge(vfsMiss, m.EveryMinuteRegister).Update(BPFMetrics[key].missedRate)
+
+				if m.Prometheus != nil {
+					m.Prometheus.RecordProbe(m.Hostname, m.RoleName, key, BPFMetrics[key])
+				}
 			}
 		}
 	}()
 	return nil
 }
 
+//RecordMissedEvents reports perf/ringbuf events the kernel dropped before
+//userspace could read them, as a proper metric rather than only the Errors
+//channel.
+func (m *Metrics) RecordMissedEvents(count uint64) {
+	metricName := fmt.Sprintf("bpf.by_host.%s.perf.missed_events.count", quote(m.Hostname))
+	goMetrics.GetOrRegisterCounter(metricName, m.EveryMinuteRegister).Inc(int64(count))
+	if m.Prometheus != nil {
+		m.Prometheus.RecordMissedEvents(count)
+	}
+}
+
+//RecordConsumerEvent increments the per-consumer event counter surfaced by
+//the realtime metrics subsystem.
+func (m *Metrics) RecordConsumerEvent(consumer string) {
+	m.eventCountsMux.Lock()
+	defer m.eventCountsMux.Unlock()
+	if m.eventCounts == nil {
+		m.eventCounts = make(map[string]uint64)
+	}
+	m.eventCounts[consumer]++
+}
+
+//fetchRealtimeSample builds a RealtimeSample from the current BPF probe
+//counters, per-consumer event counts, and the FIM watched-file count. It is
+//the default RealtimeMetrics.FetchSample implementation.
+func (m *Metrics) fetchRealtimeSample() (RealtimeSample, error) {
+	bpfMetrics, err := m.fetchBPFMetrics()
+	if err != nil {
+		return RealtimeSample{}, err
+	}
+
+	sample := RealtimeSample{
+		Timestamp:    time.Now(),
+		ProbeDeltas:  make(map[string]int64, len(bpfMetrics)),
+		MissedDeltas: make(map[string]int64, len(bpfMetrics)),
+	}
+	for probe, metric := range bpfMetrics {
+		sample.ProbeDeltas[probe] = metric.hitRate
+		sample.MissedDeltas[probe] = metric.missedRate
+	}
+
+	m.eventCountsMux.Lock()
+	sample.EventCounts = make(map[string]uint64, len(m.eventCounts))
+	for consumer, count := range m.eventCounts {
+		sample.EventCounts[consumer] = count
+	}
+	m.eventCountsMux.Unlock()
+
+	if m.FIM != nil {
+		sample.WatchedFiles = m.FIM.watchedFileCount()
+	}
+
+	return sample, nil
+}
+
 func (m *Metrics) fetchBPFMetrics() (map[string]bpfMetrics, error) {
 	BPFMetrics := make(map[string]bpfMetrics)
 
@@ -115,22 +200,19 @@ func (m *Metrics) fetchBPFMetrics() (map[string]bpfMetrics, error) {
 	for scanner.Scan() {
 		line := scanner.Text()
 		tokens := strings.Fields(line)
-
-		if strings.Contains(tokens[0], "pvfs_write") {
-			bpfMetric, err := m.parseBPFLine(tokens, provbeVfsWrite)
-			if err != nil {
-				return nil, err
-			}
-			BPFMetrics[provbeVfsWrite] = *bpfMetric
+		if len(tokens) < 3 {
+			continue
 		}
 
-		if strings.Contains(tokens[0], "pvfs_rename") {
-			bpfMetric, err := m.parseBPFLine(tokens, provbeVfsRename)
-			if err != nil {
-				return nil, err
-			}
-			BPFMetrics[provbeVfsRename] = *bpfMetric
+		probeName := tokens[0]
+		if !probeNames[probeName] {
+			continue
+		}
+		bpfMetric, err := m.parseBPFLine(tokens, probeName)
+		if err != nil {
+			return nil, err
 		}
+		BPFMetrics[probeName] = *bpfMetric
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+//PrometheusMetrics holds the collectors and listener for the pull-based
+//Prometheus scrape endpoint. It runs alongside Graphite, not instead of it.
+type PrometheusMetrics struct {
+	//ListenAddress is the address the /metrics endpoint is served on, e.g. ":9112".
+	ListenAddress string
+
+	probeHitRate    *prometheus.GaugeVec
+	probeMissedRate *prometheus.GaugeVec
+	installedHost   *prometheus.GaugeVec
+	consumeLatency  *prometheus.HistogramVec
+	queueDepth      prometheus.Gauge
+	missedEvents    prometheus.Counter
+
+	logger zerolog.Logger
+}
+
+const (
+	labelHost  = "host"
+	labelRole  = "role"
+	labelProbe = "probe"
+	labelStage = "stage"
+)
+
+//Init registers the bpfink collectors with a dedicated registry and starts the
+//HTTP server that exposes them at /metrics.
+func (p *PrometheusMetrics) Init(logger zerolog.Logger) error {
+	p.logger = logger.With().Str("metrics", "prometheus").Logger()
+
+	p.probeHitRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bpfink",
+		Subsystem: "kprobe",
+		Name:      "hit_rate",
+		Help:      "Per-probe eBPF kprobe hit rate since the last scrape interval.",
+	}, []string{labelHost, labelRole, labelProbe})
+
+	p.probeMissedRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bpfink",
+		Subsystem: "kprobe",
+		Name:      "missed_rate",
+		Help:      "Per-probe eBPF kprobe missed rate since the last scrape interval.",
+	}, []string{labelHost, labelRole, labelProbe})
+
+	p.installedHost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bpfink",
+		Name:      "installed",
+		Help:      "Set to 1 for the host/role bpfink is running on.",
+	}, []string{labelHost, labelRole})
+
+	p.consumeLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bpfink",
+		Subsystem: "consumer",
+		Name:      "latency_seconds",
+		Help:      "Consumer parse/save latency, labeled by stage.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{labelStage})
+
+	p.queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "bpfink",
+		Subsystem: "fim",
+		Name:      "event_queue_depth",
+		Help:      "Current number of events buffered in FIM.Events awaiting consumption.",
+	})
+
+	p.missedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "bpfink",
+		Subsystem: "fim",
+		Name:      "missed_events_total",
+		Help:      "Perf/ringbuf events the kernel dropped before userspace could read them.",
+	})
+
+	registry := prometheus.NewRegistry()
+	for _, c := range []prometheus.Collector{
+		p.probeHitRate, p.probeMissedRate, p.installedHost, p.consumeLatency, p.queueDepth, p.missedEvents,
+	} {
+		if err := registry.Register(c); err != nil {
+			return xerrors.Errorf("failed to register prometheus collector: %w", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		if err := http.ListenAndServe(p.ListenAddress, mux); err != nil { //nolint
+			p.logger.Error().Err(err).Msg("prometheus metrics server stopped")
+		}
+	}()
+
+	return nil
+}
+
+//RecordProbe updates the hit/missed rate gauges for a single probe.
+func (p *PrometheusMetrics) RecordProbe(host, role, probe string, m bpfMetrics) {
+	p.probeHitRate.WithLabelValues(host, role, probe).Set(float64(m.hitRate))
+	p.probeMissedRate.WithLabelValues(host, role, probe).Set(float64(m.missedRate))
+}
+
+//RecordInstalledHost marks the current host/role as running bpfink.
+func (p *PrometheusMetrics) RecordInstalledHost(host, role string) {
+	p.installedHost.WithLabelValues(host, role).Set(1)
+}
+
+//ObserveConsumeLatency records how long a consumer spent in a parse/save stage.
+func (p *PrometheusMetrics) ObserveConsumeLatency(stage string, seconds float64) {
+	p.consumeLatency.WithLabelValues(stage).Observe(seconds)
+}
+
+//SetQueueDepth records the current depth of the FIM event queue.
+func (p *PrometheusMetrics) SetQueueDepth(depth int) {
+	p.queueDepth.Set(float64(depth))
+}
+
+//RecordMissedEvents adds to the running total of dropped perf/ringbuf events.
+func (p *PrometheusMetrics) RecordMissedEvents(count uint64) {
+	p.missedEvents.Add(float64(count))
+}
@@ -0,0 +1,236 @@
+package pkg
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+//RealtimeSample is a single JSON frame streamed to a RealtimeMetrics subscriber.
+type RealtimeSample struct {
+	Timestamp    time.Time         `json:"timestamp"`
+	ProbeDeltas  map[string]int64  `json:"probe_hit_deltas"`
+	MissedDeltas map[string]int64  `json:"probe_missed_deltas"`
+	EventCounts  map[string]uint64 `json:"consumer_event_counts"`
+	WatchedFiles int               `json:"watched_files"`
+}
+
+const (
+	minRealtimeInterval     = time.Second
+	realtimeSubscriberQueue = 8
+)
+
+//RealtimeMetrics streams BPF/consumer metrics to connected clients over a
+//WebSocket, modeled on MinIO's realtime admin /metrics handler. A single
+//producer ticks at the smallest interval requested by any subscriber, and
+//fans samples out so concurrent scrapers don't multiply kprobe_profile reads;
+//each subscriber is then down-sampled to the interval it actually asked for.
+type RealtimeMetrics struct {
+	//ListenAddress is the address the websocket endpoint is served on, e.g. ":9113".
+	ListenAddress string
+	//FetchSample produces a fresh sample; normally backed by (*Metrics).fetchBPFMetrics
+	//plus consumer/FIM counters.
+	FetchSample func() (RealtimeSample, error)
+
+	logger   zerolog.Logger
+	upgrader websocket.Upgrader
+
+	mu          sync.Mutex
+	subscribers map[chan RealtimeSample]*realtimeSubscriber
+	ticker      *time.Ticker
+	tickerStop  chan struct{}
+}
+
+//realtimeSubscriber tracks a subscriber's requested cadence and when it's
+//next due a frame. The producer always ticks at the smallest interval any
+//subscriber asked for, but broadcast only delivers to a given subscriber
+//once nextSend has passed, so a slower subscriber isn't sped up by a faster
+//one sharing the same producer.
+type realtimeSubscriber struct {
+	interval time.Duration
+	nextSend time.Time
+}
+
+//Init starts the producer goroutine and the HTTP+WebSocket server.
+func (r *RealtimeMetrics) Init(logger zerolog.Logger) error {
+	if r.FetchSample == nil {
+		return xerrors.Errorf("RealtimeMetrics requires a FetchSample function")
+	}
+	r.logger = logger.With().Str("metrics", "realtime").Logger()
+	r.upgrader = websocket.Upgrader{}
+	r.subscribers = make(map[chan RealtimeSample]*realtimeSubscriber)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics/realtime", r.serveWS)
+
+	go func() {
+		if err := http.ListenAndServe(r.ListenAddress, mux); err != nil { //nolint
+			r.logger.Error().Err(err).Msg("realtime metrics server stopped")
+		}
+	}()
+
+	return nil
+}
+
+func (r *RealtimeMetrics) serveWS(w http.ResponseWriter, req *http.Request) {
+	interval, err := parseInterval(req.URL.Query().Get("interval"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := parseN(req.URL.Query().Get("n"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := r.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		r.logger.Error().Err(err).Msg("websocket upgrade failed")
+		return
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			r.logger.Error().Err(err).Msg("error closing websocket")
+		}
+	}()
+
+	sub := r.subscribe(interval)
+	defer r.unsubscribe(sub)
+
+	sent := 0
+	for sample := range sub {
+		if err := conn.WriteJSON(sample); err != nil {
+			r.logger.Debug().Err(err).Msg("client disconnected")
+			return
+		}
+		sent++
+		if n > 0 && sent >= n {
+			return
+		}
+	}
+}
+
+//subscribe registers a new subscriber channel and (re)starts the producer at
+//the smallest interval requested across all current subscribers.
+func (r *RealtimeMetrics) subscribe(interval time.Duration) chan RealtimeSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := make(chan RealtimeSample, realtimeSubscriberQueue)
+	r.subscribers[ch] = &realtimeSubscriber{interval: interval, nextSend: time.Now()}
+	r.restartProducerLocked()
+	return ch
+}
+
+func (r *RealtimeMetrics) unsubscribe(ch chan RealtimeSample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.subscribers, ch)
+	close(ch)
+	if len(r.subscribers) == 0 {
+		r.stopProducerLocked()
+		return
+	}
+	r.restartProducerLocked()
+}
+
+//restartProducerLocked reconciles the single producer goroutine with the
+//smallest interval currently requested. Callers must hold r.mu.
+func (r *RealtimeMetrics) restartProducerLocked() {
+	var smallest time.Duration
+	for _, sub := range r.subscribers {
+		if smallest == 0 || sub.interval < smallest {
+			smallest = sub.interval
+		}
+	}
+	if smallest < minRealtimeInterval {
+		smallest = minRealtimeInterval
+	}
+	r.stopProducerLocked()
+
+	r.ticker = time.NewTicker(smallest)
+	r.tickerStop = make(chan struct{})
+	ticker, stop := r.ticker, r.tickerStop
+	go r.produce(ticker, stop)
+}
+
+func (r *RealtimeMetrics) stopProducerLocked() {
+	if r.ticker != nil {
+		r.ticker.Stop()
+		close(r.tickerStop)
+		r.ticker = nil
+		r.tickerStop = nil
+	}
+}
+
+func (r *RealtimeMetrics) produce(ticker *time.Ticker, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			sample, err := r.FetchSample()
+			if err != nil {
+				r.logger.Error().Err(err).Msg("error fetching realtime sample")
+				continue
+			}
+			r.broadcast(sample)
+		}
+	}
+}
+
+//broadcast fans a sample out to every subscriber that's due one given its
+//own requested interval, dropping it for any subscriber whose channel is
+//congested rather than blocking the producer - the same drop-on-slow
+//semantics as (*FIM).error.
+func (r *RealtimeMetrics) broadcast(sample RealtimeSample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for ch, sub := range r.subscribers {
+		if now.Before(sub.nextSend) {
+			continue
+		}
+		select {
+		case ch <- sample:
+			sub.nextSend = now.Add(sub.interval)
+		default:
+		}
+	}
+}
+
+func parseInterval(raw string) (time.Duration, error) {
+	if raw == "" {
+		return minRealtimeInterval, nil
+	}
+	interval, err := time.ParseDuration(raw)
+	if err != nil {
+		secs, serr := strconv.Atoi(raw)
+		if serr != nil {
+			return 0, xerrors.Errorf("invalid interval %q: %w", raw, err)
+		}
+		interval = time.Duration(secs) * time.Second
+	}
+	if interval < minRealtimeInterval {
+		return 0, xerrors.Errorf("interval must be at least %s", minRealtimeInterval)
+	}
+	return interval, nil
+}
+
+func parseN(raw string) (int, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, xerrors.Errorf("invalid n %q", raw)
+	}
+	return n, nil
+}
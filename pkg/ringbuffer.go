@@ -0,0 +1,199 @@
+package pkg
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ringbufSupported reports whether the running kernel is new enough (5.8+)
+//to expose BPF_MAP_TYPE_RINGBUF. This is detection-only: gobpf/elf, the
+//library this package uses to load BPF programs, has no ring buffer support
+//of its own, so start() always uses the perf buffer regardless of what this
+//returns. It exists so operators can tell a perf-buffer-only deployment from
+//a future one once gobpf/elf (or a replacement) grows ring buffer support -
+//it does not gate any ingest behavior today.
+func ringbufSupported() bool {
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return false
+	}
+	major, minor, ok := parseKernelVersion(strings.TrimSpace(string(release)))
+	if !ok {
+		return false
+	}
+	return major > 5 || (major == 5 && minor >= 8)
+}
+
+//parseKernelVersion extracts the major/minor version from a uname release
+//string such as "5.15.0-91-generic".
+func parseKernelVersion(release string) (major, minor int, ok bool) {
+	fields := strings.SplitN(release, ".", 3)
+	if len(fields) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+//coalesceKey identifies a pending summary event. Inode alone isn't enough:
+//a write followed by a chmod/unlink on the same inode are distinct,
+//security-relevant operations and must not be folded into one summary that
+//only keeps the first event's Op and metadata.
+type coalesceKey struct {
+	inode uint64
+	op    Operation
+}
+
+//coalescer sits between the BPF ingest loop and FIM.Events. Under normal
+//load every event is forwarded immediately. Once the downstream channel is
+//over backpressureThreshold full, duplicate events for the same inode and
+//operation are folded into a single summary event (HitCount > 1) and
+//flushed on a self-tuning interval instead of one send per event.
+type coalescer struct {
+	out chan Event
+
+	mu      sync.Mutex
+	pending map[coalesceKey]Event
+	window  time.Duration
+
+	rateMu    sync.Mutex
+	rateCount int
+	rateSince time.Time
+
+	stop chan struct{}
+}
+
+func newCoalescer(out chan Event) *coalescer {
+	c := &coalescer{
+		out:       out,
+		pending:   make(map[coalesceKey]Event),
+		window:    coalesceWindowMin,
+		rateSince: time.Time{},
+		stop:      make(chan struct{}),
+	}
+	go c.flushLoop()
+	return c
+}
+
+//Stop ends the background flush loop and flushes pending events once,
+//without blocking. Events that don't fit in the output channel at that
+//point stay pending and are not delivered.
+func (c *coalescer) Stop() {
+	close(c.stop)
+	c.flush()
+}
+
+//Submit forwards e immediately when the output channel has headroom, or
+//folds it into a pending per-inode, per-operation summary once the channel is over
+//backpressureThreshold full.
+func (c *coalescer) Submit(e Event) {
+	c.observeRate()
+
+	if e.HitCount == 0 {
+		e.HitCount = 1
+	}
+
+	fillRatio := float64(len(c.out)) / float64(cap(c.out))
+	if fillRatio < backpressureThreshold {
+		select {
+		case c.out <- e:
+		default:
+			c.mergePending(e)
+		}
+		return
+	}
+	c.mergePending(e)
+}
+
+func (c *coalescer) mergePending(e Event) {
+	key := coalesceKey{inode: e.Inode, op: e.Op}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.pending[key]; ok {
+		existing.HitCount += e.HitCount
+		c.pending[key] = existing
+		return
+	}
+	c.pending[key] = e
+}
+
+func (c *coalescer) flushLoop() {
+	for {
+		c.mu.Lock()
+		window := c.window
+		c.mu.Unlock()
+
+		select {
+		case <-time.After(window):
+		case <-c.stop:
+			return
+		}
+		c.adjustWindow()
+		c.flush()
+	}
+}
+
+func (c *coalescer) flush() {
+	c.mu.Lock()
+	if len(c.pending) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	pending := c.pending
+	c.pending = make(map[coalesceKey]Event)
+	c.mu.Unlock()
+
+	//Non-blocking: flush runs on the same timer/shutdown path as Stop, so a
+	//still-full c.out must not be able to hang it. An event that doesn't fit
+	//goes back through mergePending rather than blocking.
+	for _, e := range pending {
+		select {
+		case c.out <- e:
+		default:
+			c.mergePending(e)
+		}
+	}
+}
+
+func (c *coalescer) observeRate() {
+	c.rateMu.Lock()
+	defer c.rateMu.Unlock()
+	c.rateCount++
+}
+
+//adjustWindow grows the coalesce window towards coalesceWindowMax under
+//sustained high event rates, and decays it back to coalesceWindowMin once
+//the rate drops - a self-tuning stand-in for a poll interval, since the
+//underlying perf buffer poll loop runs continuously and isn't user-tunable.
+func (c *coalescer) adjustWindow() {
+	c.rateMu.Lock()
+	count := c.rateCount
+	c.rateCount = 0
+	c.rateMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	const highRateEventsPerTick = 100
+	switch {
+	case count > highRateEventsPerTick && c.window < coalesceWindowMax:
+		c.window *= 2
+		if c.window > coalesceWindowMax {
+			c.window = coalesceWindowMax
+		}
+	case count <= highRateEventsPerTick && c.window > coalesceWindowMin:
+		c.window /= 2
+		if c.window < coalesceWindowMin {
+			c.window = coalesceWindowMin
+		}
+	}
+}
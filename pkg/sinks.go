@@ -0,0 +1,192 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+//NotifyEvent is the payload handed to every NotifySink when a consumer
+//detects a state change.
+type NotifyEvent struct {
+	Consumer    string    `json:"consumer"`
+	Process     string    `json:"process"`
+	ContainerID string    `json:"container_id,omitempty"`
+	Message     string    `json:"message"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+//NotifySink is a destination for consumer Notify events, in addition to the
+//default zerolog warn stream. Implementations must not block the caller for
+//long; the bounded queue in bufferedSink is the expected way to decouple a
+//slow remote sink from the consumer goroutine.
+type NotifySink interface {
+	Send(NotifyEvent) error
+}
+
+const (
+	sinkQueueSize  = 256
+	sinkRetries    = 3
+	sinkRetryDelay = time.Second
+)
+
+//bufferedSink wraps a NotifySink with a bounded in-memory queue and a
+//background worker that retries with backoff. Overflow is surfaced on the
+//errors channel, matching the drop-and-report semantics of (*FIM).error.
+type bufferedSink struct {
+	sink   NotifySink
+	queue  chan NotifyEvent
+	errors chan error
+}
+
+//newBufferedSink starts the background worker and returns the wrapped sink.
+//errors may be nil, in which case overflow/send failures are simply dropped.
+func newBufferedSink(sink NotifySink, errors chan error) *bufferedSink {
+	bs := &bufferedSink{
+		sink:   sink,
+		queue:  make(chan NotifyEvent, sinkQueueSize),
+		errors: errors,
+	}
+	go bs.run()
+	return bs
+}
+
+func (bs *bufferedSink) Send(event NotifyEvent) error {
+	select {
+	case bs.queue <- event:
+		return nil
+	default:
+		err := xerrors.Errorf("notify sink queue overflow, dropping event for consumer %q", event.Consumer)
+		bs.reportError(err)
+		return err
+	}
+}
+
+func (bs *bufferedSink) reportError(err error) {
+	if bs.errors == nil {
+		return
+	}
+	select {
+	case bs.errors <- err:
+	default:
+	}
+}
+
+func (bs *bufferedSink) run() {
+	for event := range bs.queue {
+		var err error
+		for attempt := 0; attempt < sinkRetries; attempt++ {
+			if err = bs.sink.Send(event); err == nil {
+				break
+			}
+			time.Sleep(sinkRetryDelay * time.Duration(attempt+1))
+		}
+		if err != nil {
+			bs.reportError(xerrors.Errorf("notify sink failed after %d attempts: %w", sinkRetries, err))
+		}
+	}
+}
+
+/* --------------------------------- SYSLOG --------------------------------- */
+
+//SyslogSink sends notify events to the local syslog daemon through the
+//stdlib log/syslog writer, which frames them in BSD syslog (RFC 3164) style;
+//the messages are not RFC 5424 formatted.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+//NewSyslogSink connects to the local syslog daemon.
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	writer, err := syslog.New(syslog.LOG_WARNING|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to connect to local syslog: %w", err)
+	}
+	return &SyslogSink{writer: writer}, nil
+}
+
+//Send writes the event to syslog as a warning.
+func (s *SyslogSink) Send(event NotifyEvent) error {
+	return s.writer.Warning(formatNotifyEvent(event))
+}
+
+//RemoteSyslogSink sends notify events to a remote syslog collector over TCP,
+//optionally wrapped in TLS. The stdlib log/syslog package has no TLS dial
+//support, so a TLS connection is framed and written to directly as RFC 5424.
+type RemoteSyslogSink struct {
+	tag  string
+	conn net.Conn
+}
+
+//NewRemoteSyslogSink dials a remote syslog collector. When tlsConfig is
+//non-nil the connection is established over TLS; otherwise plain TCP is used.
+func NewRemoteSyslogSink(addr, tag string, tlsConfig *tls.Config) (*RemoteSyslogSink, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("failed to dial remote syslog at %q: %w", addr, err)
+	}
+	return &RemoteSyslogSink{tag: tag, conn: conn}, nil
+}
+
+//Send writes the event to the remote syslog collector as an RFC 5424 message.
+func (r *RemoteSyslogSink) Send(event NotifyEvent) error {
+	line := fmt.Sprintf("<%d>1 %s %s %s - - - %s\n",
+		syslog.LOG_WARNING|syslog.LOG_DAEMON, event.Timestamp.Format(time.RFC3339), r.tag, r.tag,
+		formatNotifyEvent(event))
+	_, err := r.conn.Write([]byte(line))
+	return err
+}
+
+func formatNotifyEvent(event NotifyEvent) string {
+	return fmt.Sprintf("consumer=%s process=%s container=%s message=%s",
+		event.Consumer, event.Process, event.ContainerID, event.Message)
+}
+
+/* -------------------------------- WEBHOOK -------------------------------- */
+
+//WebhookSink posts notify events as JSON to an HTTP endpoint.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+//NewWebhookSink builds a WebhookSink with a sane default timeout.
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+//Send POSTs the event as JSON to the configured URL.
+func (w *WebhookSink) Send(event NotifyEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return xerrors.Errorf("failed to encode notify event: %w", err)
+	}
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return xerrors.Errorf("failed to post notify event: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			_ = err
+		}
+	}()
+	if resp.StatusCode >= 300 {
+		return xerrors.Errorf("webhook sink received status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	clientv3 "go.etcd.io/etcd/clientv3"
+	"golang.org/x/xerrors"
+)
+
+func encodeUsers(users Users) ([]byte, error) {
+	data, err := json.Marshal(users)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to encode users baseline: %w", err)
+	}
+	return data, nil
+}
+
+func decodeUsers(data []byte) (Users, error) {
+	var users Users
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, xerrors.Errorf("failed to decode users baseline: %w", err)
+	}
+	return users, nil
+}
+
+func encodeAccess(access Access) ([]byte, error) {
+	data, err := json.Marshal(access)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to encode access baseline: %w", err)
+	}
+	return data, nil
+}
+
+func decodeAccess(data []byte) (Access, error) {
+	var access Access
+	if err := json.Unmarshal(data, &access); err != nil {
+		return Access{}, xerrors.Errorf("failed to decode access baseline: %w", err)
+	}
+	return access, nil
+}
+
+//ReadThroughCache caches StateStore values locally, falling back to a
+//loader function (the remote backend's Get) on a miss.
+type ReadThroughCache struct {
+	mu    sync.RWMutex
+	cache map[string][]byte
+	load  func(key string) ([]byte, error)
+}
+
+//NewReadThroughCache builds a cache backed by the given loader function.
+func NewReadThroughCache(load func(key string) ([]byte, error)) *ReadThroughCache {
+	return &ReadThroughCache{cache: make(map[string][]byte), load: load}
+}
+
+//Get returns the cached value for key, loading and caching it on a miss.
+func (c *ReadThroughCache) Get(key string) ([]byte, error) {
+	c.mu.RLock()
+	if data, ok := c.cache[key]; ok {
+		c.mu.RUnlock()
+		return data, nil
+	}
+	c.mu.RUnlock()
+
+	data, err := c.load(key)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.cache[key] = data
+	c.mu.Unlock()
+	return data, nil
+}
+
+//Invalidate drops a key from the cache, forcing the next Get to reload it.
+func (c *ReadThroughCache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.cache, key)
+}
+
+//StateStore abstracts the baseline persistence used by every consumer.
+//*AgentDB (bolt-backed, local to a single host) is the default
+//implementation; EtcdStore and ConsulStore let a fleet of bpfink agents
+//share and compare baselines centrally.
+type StateStore interface {
+	SaveUsers(Users) error
+	LoadUsers() (Users, error)
+	SaveAccess(Access) error
+	LoadAccess() (Access, error)
+	//Save/Load are the generic key/value path future consumers use instead of
+	//growing this interface with a new pair of methods per consumer.
+	Save(key string, data []byte) error
+	Load(key string) ([]byte, error)
+}
+
+//ErrKeyNotFound is returned by Load (and by LoadUsers/LoadAccess on a fresh
+//baseline) when the requested key has never been saved. Every StateStore
+//implementation wraps it with xerrors.Errorf("...: %w", ErrKeyNotFound) so
+//callers can distinguish "no baseline yet" from a real backend failure with
+//errors.Is.
+var ErrKeyNotFound = errors.New("state store: key not found")
+
+const storeOpTimeout = 5 * time.Second
+
+/* --------------------------------- ETCD ---------------------------------- */
+
+//EtcdStore is a StateStore backed by an etcd cluster, so multiple bpfink
+//agents can share or compare baselines.
+type EtcdStore struct {
+	client *clientv3.Client
+	prefix string
+	cache  *ReadThroughCache
+}
+
+//NewEtcdStore dials the given etcd endpoints and returns a StateStore.
+//prefix namespaces all keys, e.g. "bpfink/<hostname>/".
+func NewEtcdStore(endpoints []string, prefix string) (*EtcdStore, error) {
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: storeOpTimeout})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to connect to etcd: %w", err)
+	}
+	store := &EtcdStore{client: client, prefix: prefix}
+	store.cache = NewReadThroughCache(store.load)
+	return store, nil
+}
+
+//SaveUsers persists the users baseline under "<prefix>users".
+func (e *EtcdStore) SaveUsers(users Users) error {
+	data, err := encodeUsers(users)
+	if err != nil {
+		return err
+	}
+	return e.Save("users", data)
+}
+
+//LoadUsers reads the users baseline from "<prefix>users".
+func (e *EtcdStore) LoadUsers() (Users, error) {
+	data, err := e.Load("users")
+	if err != nil {
+		return nil, err
+	}
+	return decodeUsers(data)
+}
+
+//SaveAccess persists the access baseline under "<prefix>access".
+func (e *EtcdStore) SaveAccess(access Access) error {
+	data, err := encodeAccess(access)
+	if err != nil {
+		return err
+	}
+	return e.Save("access", data)
+}
+
+//LoadAccess reads the access baseline from "<prefix>access".
+func (e *EtcdStore) LoadAccess() (Access, error) {
+	data, err := e.Load("access")
+	if err != nil {
+		return Access{}, err
+	}
+	return decodeAccess(data)
+}
+
+//Save writes a value to etcd and invalidates the local read-through cache.
+func (e *EtcdStore) Save(key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+	if _, err := e.client.Put(ctx, e.prefix+key, string(data)); err != nil {
+		return xerrors.Errorf("etcd put %q failed: %w", key, err)
+	}
+	e.cache.Invalidate(key)
+	return nil
+}
+
+//Load reads a value through the local cache, falling back to etcd on a miss.
+func (e *EtcdStore) Load(key string) ([]byte, error) {
+	return e.cache.Get(key)
+}
+
+func (e *EtcdStore) load(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+	resp, err := e.client.Get(ctx, e.prefix+key)
+	if err != nil {
+		return nil, xerrors.Errorf("etcd get %q failed: %w", key, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, xerrors.Errorf("etcd key %q not found: %w", key, ErrKeyNotFound)
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+/* -------------------------------- CONSUL --------------------------------- */
+
+//ConsulStore is a StateStore backed by Consul's KV store.
+type ConsulStore struct {
+	kv     *api.KV
+	prefix string
+	cache  *ReadThroughCache
+}
+
+//NewConsulStore connects to Consul and returns a StateStore. prefix
+//namespaces all keys, e.g. "bpfink/<hostname>/".
+func NewConsulStore(addr, prefix string) (*ConsulStore, error) {
+	client, err := api.NewClient(&api.Config{Address: addr})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to connect to consul: %w", err)
+	}
+	store := &ConsulStore{kv: client.KV(), prefix: prefix}
+	store.cache = NewReadThroughCache(store.load)
+	return store, nil
+}
+
+//SaveUsers persists the users baseline under "<prefix>users".
+func (c *ConsulStore) SaveUsers(users Users) error {
+	data, err := encodeUsers(users)
+	if err != nil {
+		return err
+	}
+	return c.Save("users", data)
+}
+
+//LoadUsers reads the users baseline from "<prefix>users".
+func (c *ConsulStore) LoadUsers() (Users, error) {
+	data, err := c.Load("users")
+	if err != nil {
+		return nil, err
+	}
+	return decodeUsers(data)
+}
+
+//SaveAccess persists the access baseline under "<prefix>access".
+func (c *ConsulStore) SaveAccess(access Access) error {
+	data, err := encodeAccess(access)
+	if err != nil {
+		return err
+	}
+	return c.Save("access", data)
+}
+
+//LoadAccess reads the access baseline from "<prefix>access".
+func (c *ConsulStore) LoadAccess() (Access, error) {
+	data, err := c.Load("access")
+	if err != nil {
+		return Access{}, err
+	}
+	return decodeAccess(data)
+}
+
+//Save writes a value to Consul KV and invalidates the local read-through cache.
+func (c *ConsulStore) Save(key string, data []byte) error {
+	pair := &api.KVPair{Key: c.prefix + key, Value: data}
+	if _, err := c.kv.Put(pair, nil); err != nil {
+		return xerrors.Errorf("consul put %q failed: %w", key, err)
+	}
+	c.cache.Invalidate(key)
+	return nil
+}
+
+//Load reads a value through the local cache, falling back to Consul on a miss.
+func (c *ConsulStore) Load(key string) ([]byte, error) {
+	return c.cache.Get(key)
+}
+
+func (c *ConsulStore) load(key string) ([]byte, error) {
+	pair, _, err := c.kv.Get(c.prefix+key, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("consul get %q failed: %w", key, err)
+	}
+	if pair == nil {
+		return nil, xerrors.Errorf("consul key %q not found: %w", key, ErrKeyNotFound)
+	}
+	return pair.Value, nil
+}
+
+/* ------------------------------ SYNC / RECONCILE --------------------------- */
+
+//Sync reconciles the local baseline against a remote StateStore on startup.
+//When the two disagree, the remote baseline wins and ErrReload is returned
+//so the caller re-enters the same startup path a fresh baseline would take.
+func Sync(local, remote StateStore) error {
+	reload := false
+
+	localUsers, err := local.LoadUsers()
+	if err != nil {
+		return xerrors.Errorf("sync: failed to load local users: %w", err)
+	}
+	remoteUsers, err := remote.LoadUsers()
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		//Remote has no users baseline yet - nothing to reconcile. Diffing
+		//against a zero-value Users would make every local entry look
+		//"deleted" and wipe the local baseline the moment it's adopted.
+	case err != nil:
+		return xerrors.Errorf("sync: failed to load remote users: %w", err)
+	default:
+		add, del := userDiff(localUsers, remoteUsers)
+		if len(add) != 0 || len(del) != 0 {
+			if err := local.SaveUsers(remoteUsers); err != nil {
+				return xerrors.Errorf("sync: failed to adopt remote users baseline: %w", err)
+			}
+			reload = true
+		}
+	}
+
+	localAccess, err := local.LoadAccess()
+	if err != nil {
+		return xerrors.Errorf("sync: failed to load local access: %w", err)
+	}
+	remoteAccess, err := remote.LoadAccess()
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		//Same as above: an absent remote access baseline is not a diff.
+	case err != nil:
+		return xerrors.Errorf("sync: failed to load remote access: %w", err)
+	default:
+		accessAdd, accessDel := accessDiff(localAccess, remoteAccess)
+		if !accessAdd.IsEmpty() || !accessDel.IsEmpty() {
+			if err := local.SaveAccess(remoteAccess); err != nil {
+				return xerrors.Errorf("sync: failed to adopt remote access baseline: %w", err)
+			}
+			reload = true
+		}
+	}
+
+	if reload {
+		return ErrReload
+	}
+	return nil
+}